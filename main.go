@@ -24,177 +24,208 @@ package main
 
 import (
 	"bufio"
-	"bytes"
 	"crypto/hmac"
 	"crypto/md5"
+	"crypto/tls"
+	"encoding/base64"
 	"encoding/hex"
 	"errors"
 	"flag"
-	"io/ioutil"
+	"fmt"
 	"log"
-	"net"
 	"net/mail"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/delucks/smtpd"
-	"github.com/gregdel/pushover"
+	"github.com/emersion/go-smtp"
 )
 
 // An Envelope represents an email that is finalized, parsed, and ready for
-// submission.
+// submission. Priority, Sound, Device, TTL, and Retry are notification
+// parameters filled in by Rules.Apply; backends that don't support them
+// (anything but Pushover) simply ignore them.
 type Envelope struct {
 	From string
 	To   string
 	Msg  *mail.Message
-}
-
-// SendPushover converts an Envelope into a Pushover notification. In the event
-// of an error condition, retryable indicates whether or not the Envelope can be
-// resent.
-func SendPushover(e *Envelope, api *pushover.Pushover) (retryable bool, err error) {
-	sub := e.Msg.Header.Get("Subject")
-	if sub == "" {
-		sub = "(no subject)"
-	}
-	body, err := ioutil.ReadAll(e.Msg.Body)
-	if err != nil {
-		retryable = false
-		return
-	}
-	user, _ := parseEmail(e.To)
-	rcpt := pushover.NewRecipient(user)
-	_, err = api.GetRecipientDetails(rcpt)
-	if err != nil {
-		retryable = false
-		return
-	}
 
-	push := pushover.NewMessageWithTitle(string(body), sub+" ("+e.From+")")
-	resp, err := api.SendMessage(push, rcpt)
-	if err != nil {
-		retryable = resp != nil && resp.Status != 1
-		return
-	}
-	retryable = false
-	return
+	Priority *int
+	Sound    string
+	Device   string
+	TTL      int
+	Retry    int
 }
 
 // Config holds all parameters for SMTP Translator.
 type Config struct {
 	Addr        string
-	AuthDb      map[string]string
+	AuthDb      map[string]authRecord
 	Hostname    string
 	TLSCert     string
 	TLSKey      string
 	Starttls    bool
 	StarttlsReq bool
 
-	PushoverToken string
-	PushoverRcpt  string
+	// Notifiers maps a recipient domain (e.g. "api.pushover.net",
+	// "ntfy.sh") to the backend that should handle mail addressed to it.
+	Notifiers map[string]Notifier
+
+	// SpoolDir holds the durable on-disk queue of accepted-but-undelivered
+	// envelopes. See Queue.
+	SpoolDir string
+	// MaxAttempts is the number of delivery attempts before an envelope is
+	// moved to the dead-letter directory.
+	MaxAttempts int
+	// LMTP serves LMTP instead of SMTP, for use behind a local MTA.
+	LMTP bool
+
+	// Rules maps envelopes to Pushover priority/sound/device/retry
+	// overrides based on sender and subject.
+	Rules Rules
 }
 
 // ListenAndServe runs an instance of SMTP Translator. It takes a server
 // configuration and a logger for non-fatal errors.
 func ListenAndServe(c *Config, errl *log.Logger) error {
-	q := make(chan *Envelope, 10)
-	api := pushover.New(c.PushoverToken)
-	server := smtpd.Server{
-		Addr:         c.Addr,
-		Appname:      "SMTP-Translator",
-		AuthRequired: len(c.AuthDb) > 0,
-		Hostname:     c.Hostname,
-		MaxSize:      1024 * 4, // per https://pushover.net/api#limits
-		TLSListener:  !c.Starttls && !c.StarttlsReq,
-		TLSRequired:  c.StarttlsReq,
-		AuthHandler: func(remoteAddr net.Addr, mechanism string, username []byte, password []byte, shared []byte) (bool, error) {
-			if len(c.AuthDb) <= 0 {
-				return true, nil
-			}
-			switch mechanism {
-			case "PLAIN", "LOGIN":
-				return authPlaintext(c.AuthDb, string(username), string(password)), nil
-			case "CRAM-MD5":
-				// username = username, password = hmac, shared = challenge
-				// (see github.com/mhale/smtpd/smtpd.go)
-				return authCramMd5(c.AuthDb, string(username), password, shared)
-			}
-			panic(mechanism)
-		},
-		HandlerRcpt: func(remoteAddr net.Addr, from string, to string) bool {
-			_, dom := parseEmail(to)
-			switch dom {
-			case "api.pushover.net", "pomail.net":
-				return true
-			default:
-				return false
-			}
-		},
-		Handler: func(remoteAddr net.Addr, from string, to []string, data []byte) {
-			msg, err := mail.ReadMessage(bytes.NewReader(data))
-			if err != nil {
-				return
-			}
-			for _, rcpt := range to {
-				_, dom := parseEmail(rcpt)
-				switch dom {
-				case "api.pushover.net", "pomail.net":
-					q <- &Envelope{
-						From: from,
-						To:   rcpt,
-						Msg:  msg}
-				default:
-					errl.Println("bad domain in address:", dom)
-				}
-			}
-		}}
+	q, err := NewQueue(c.SpoolDir, c.MaxAttempts)
+	if err != nil {
+		return err
+	}
+	go runWorker(q, c.Notifiers, c.Rules, errl)
+
+	be := &Backend{Config: c, Queue: q, Errl: errl}
+	s := smtp.NewServer(be)
+	s.Addr = c.Addr
+	s.Domain = c.Hostname
+	s.LMTP = c.LMTP
+	s.EnableSMTPUTF8 = true
+	s.MaxMessageBytes = maxMessageBytes
+	s.AllowInsecureAuth = len(c.AuthDb) == 0 || (c.TLSCert == "" && !c.Starttls && !c.StarttlsReq)
+
 	if c.TLSCert != "" && c.TLSKey != "" {
-		if err := server.ConfigureTLS(c.TLSCert, c.TLSKey); err != nil {
+		cert, err := tls.LoadX509KeyPair(c.TLSCert, c.TLSKey)
+		if err != nil {
 			return err
 		}
+		s.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+		if !c.Starttls && !c.StarttlsReq {
+			return s.ListenAndServeTLS()
+		}
 	}
-	go func() {
-		for {
-			var e *Envelope = <-q
-			for {
-				retry, err := SendPushover(e, api)
-				if err != nil && retry {
-					errl.Println(err, "(retrying in 10 seconds)")
-					time.Sleep(10 * time.Second)
-					continue
-				} else if err != nil {
-					errl.Println(err, "(not recoverable)")
-				}
-				break
-			}
+	return s.ListenAndServe()
+}
+
+// runWorker repeatedly drains due envelopes from q and hands them to the
+// Notifier for their recipient's domain, retrying every failed delivery with
+// backoff (a Notifier's retryable result is not consulted) and logging queue
+// depth and per-recipient failure counts so operators can tell when a
+// backend is degraded. Envelopes in a single batch are delivered
+// concurrently so one slow backend doesn't hold up the rest of that batch;
+// the next batch starts only once every delivery in the current one returns.
+func runWorker(q *Queue, notifiers map[string]Notifier, rules Rules, errl *log.Logger) {
+	failures := make(map[string]int)
+	var failuresMu sync.Mutex
+	for {
+		ids, err := q.Due(time.Now())
+		if err != nil {
+			errl.Println("spool read failed:", err)
+			time.Sleep(q.BaseDelay)
+			continue
+		}
+		if len(ids) == 0 {
+			time.Sleep(time.Second)
+			continue
 		}
-	}()
-	return server.ListenAndServe()
+		var wg sync.WaitGroup
+		for _, id := range ids {
+			wg.Add(1)
+			go func(id string) {
+				defer wg.Done()
+				deliverOne(q, notifiers, rules, errl, id, failures, &failuresMu)
+			}(id)
+		}
+		wg.Wait()
+	}
+}
+
+// deliverOne loads and attempts delivery of a single spooled envelope. It's
+// the per-envelope body of runWorker's batch loop, split out so each
+// envelope in a batch can run in its own goroutine; failures/failuresMu
+// guard the shared per-recipient failure count across those goroutines.
+func deliverOne(q *Queue, notifiers map[string]Notifier, rules Rules, errl *log.Logger, id string, failures map[string]int, failuresMu *sync.Mutex) {
+	e, meta, err := q.Load(id)
+	if err != nil {
+		errl.Println("spool entry unreadable, dropping:", id, err)
+		q.Done(id)
+		return
+	}
+	_, dom := parseEmail(e.To)
+	notifier, ok := notifiers[dom]
+	if !ok {
+		errl.Println("no notifier configured for domain, dropping:", dom)
+		q.Done(id)
+		return
+	}
+	rules.Apply(e)
+	_, nerr := notifier.Notify(e)
+	if nerr == nil {
+		q.Done(id)
+		failuresMu.Lock()
+		delete(failures, e.To)
+		failuresMu.Unlock()
+		return
+	}
+	failuresMu.Lock()
+	failures[e.To]++
+	n := failures[e.To]
+	failuresMu.Unlock()
+	dead, rerr := q.Retry(id, meta)
+	if rerr != nil {
+		errl.Println("spool update failed:", rerr)
+	}
+	if dead {
+		errl.Printf("recipient=%s attempts=%d failures=%d depth=%d: %v (moved to dead-letter)", e.To, meta.Attempts+1, n, mustDepth(q), nerr)
+	} else {
+		errl.Printf("recipient=%s attempts=%d failures=%d depth=%d: %v (retrying)", e.To, meta.Attempts+1, n, mustDepth(q), nerr)
+	}
+}
+
+func mustDepth(q *Queue) int {
+	n, err := q.Depth()
+	if err != nil {
+		return -1
+	}
+	return n
 }
 
-func authPlaintext(db map[string]string, user, pw string) bool {
-	return db[user] != "" && db[user] == pw
+func authPlaintext(db map[string]authRecord, user, pw string) bool {
+	rec, ok := db[user]
+	return ok && rec.scheme == "plain" && rec.password == pw
 }
 
 // authCramMd5 implements the CRAM-MD5 SMTP authentication method, which compares
 // a user-submitted HMAC with an expected HMAC that is derived from a shared
-// secret (in SMTP Translator's case, the plaintext password).
-func authCramMd5(db map[string]string, user string, mac, chal []byte) (bool, error) {
-	if db[user] == "" {
+// secret. Since CRAM-MD5 requires the server to reproduce the client's HMAC,
+// it only works against "plain" auth file entries, not hashed SCRAM ones.
+func authCramMd5(db map[string]authRecord, user string, mac, chal []byte) (bool, error) {
+	rec, ok := db[user]
+	if !ok || rec.scheme != "plain" {
 		return false, nil
 	}
 	// https://en.wikipedia.org/wiki/CRAM-MD5#Protocol
-	rec := make([]byte, hex.DecodedLen(len(mac)))
-	n, err := hex.Decode(rec, mac)
+	dec := make([]byte, hex.DecodedLen(len(mac)))
+	n, err := hex.Decode(dec, mac)
 	if err != nil {
 		return false, err
 	}
-	rec = rec[:n]
-	mymac := hmac.New(md5.New, []byte(db[user]))
+	dec = dec[:n]
+	mymac := hmac.New(md5.New, []byte(rec.password))
 	mymac.Write(chal)
 	exp := mymac.Sum(nil)
-	return hmac.Equal(exp, rec), nil
+	return hmac.Equal(exp, dec), nil
 }
 
 func parseEmail(addr string) (user string, dom string) {
@@ -234,8 +265,37 @@ func getConfig() (*Config, error) {
 		"if using TLS, accept unencrypted connections that may upgrade with STARTTLS")
 	starttlsReq := flag.Bool("starttls-always", false,
 		"if using TLS, accept unencrypted connections that MUST upgrade with STARTTLS")
+	routesp := flag.String("routes", "",
+		"load recipient domain to notifier backend routes from `file`; if unset, "+
+			"falls back to a single Pushover backend for api.pushover.net and pomail.net")
+	spoolDir := flag.String("spool", "/var/spool/smtp-translator",
+		"`directory` for the durable on-disk delivery queue and dead-letter mail")
+	maxAttempts := flag.Int("max-attempts", 8,
+		"give up and dead-letter an envelope after this many failed delivery attempts")
+	lmtp := flag.Bool("lmtp", false,
+		"serve LMTP instead of SMTP, for use behind a local MTA")
+	genScramUser := flag.String("gen-scram-user", "",
+		"print a SCRAM-SHA-256 auth file line for `user` (password read from stdin) and exit, "+
+			"instead of starting the server")
+	scramIters := flag.Int("scram-iters", 4096,
+		"PBKDF2 iteration count used by -gen-scram-user")
+	rulesp := flag.String("rules", "",
+		"load sender/subject-based priority/sound/device routing rules from `file`")
 	flag.Parse()
 
+	if *genScramUser != "" {
+		pw, err := readPasswordLine(os.Stdin)
+		if err != nil {
+			return nil, err
+		}
+		rec, err := deriveScramRecord(schemeScramSHA256, pw, *scramIters)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Printf("%s:%s\n", *genScramUser, encodeScramRecord(rec))
+		os.Exit(0)
+	}
+
 	if (*tlsCert != "" || *tlsKey != "") && (*tlsCert == "" || *tlsKey == "") {
 		return nil, errors.New("must specify both -tls-cert and -tls-key")
 	}
@@ -245,12 +305,31 @@ func getConfig() (*Config, error) {
 	if (*starttls || *starttlsReq) && (*tlsCert == "" || *tlsKey == "") {
 		return nil, errors.New("must specify -tls-cert and -tls-key to use TLS")
 	}
-	token, ok := os.LookupEnv("PUSHOVER_TOKEN")
-	if !ok {
-		return nil, errors.New("missing env: $PUSHOVER_TOKEN")
+	token, _ := os.LookupEnv("PUSHOVER_TOKEN")
+
+	var notifiers map[string]Notifier
+	if *routesp != "" {
+		routesf, err := os.Open(*routesp)
+		if err != nil {
+			return nil, err
+		}
+		notifiers, err = readRoutes(routesf, token)
+		routesf.Close()
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		if token == "" {
+			return nil, errors.New("missing env: $PUSHOVER_TOKEN (or configure backends with -routes)")
+		}
+		p := NewPushoverNotifier(token)
+		notifiers = map[string]Notifier{
+			"api.pushover.net": p,
+			"pomail.net":       p,
+		}
 	}
 
-	var authdb map[string]string
+	var authdb map[string]authRecord
 	if *authp != "" {
 		authf, err := os.Open(*authp)
 		if err != nil {
@@ -263,6 +342,19 @@ func getConfig() (*Config, error) {
 		}
 	}
 
+	var rules Rules
+	if *rulesp != "" {
+		rulesf, err := os.Open(*rulesp)
+		if err != nil {
+			return nil, err
+		}
+		rules, err = readRules(rulesf)
+		rulesf.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	return &Config{
 		Addr:        *addr,
 		AuthDb:      authdb,
@@ -272,18 +364,142 @@ func getConfig() (*Config, error) {
 		Starttls:    *starttls,
 		StarttlsReq: *starttlsReq,
 
-		PushoverToken: token}, nil
+		Notifiers:   notifiers,
+		SpoolDir:    *spoolDir,
+		MaxAttempts: *maxAttempts,
+		LMTP:        *lmtp,
+		Rules:       rules}, nil
 }
 
-func readAuth(fd *os.File) (db map[string]string, err error) {
-	db = make(map[string]string)
+// readPasswordLine reads a single line (minus its trailing newline) from r,
+// used to take a password on stdin for -gen-scram-user.
+func readPasswordLine(r *os.File) (string, error) {
+	scanner := bufio.NewScanner(r)
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return "", err
+		}
+		return "", errors.New("no password given on stdin")
+	}
+	return scanner.Text(), nil
+}
+
+// readAuth parses the auth file. Each line is either the legacy
+//
+//	user:password
+//
+// form (used for PLAIN/LOGIN/CRAM-MD5), or a hashed SCRAM entry
+//
+//	user:SCRAM-SHA-256$<iters>:<salt-b64>:<StoredKey-b64>:<ServerKey-b64>
+//
+// so operators aren't forced to keep plaintext passwords at rest just to
+// support CRAM-MD5.
+func readAuth(fd *os.File) (db map[string]authRecord, err error) {
+	db = make(map[string]authRecord)
 	scanner := bufio.NewScanner(fd)
 	for scanner.Scan() {
-		split := strings.Split(scanner.Text(), ":")
-		if len(split) == 2 {
-			db[split[0]] = split[1]
+		line := scanner.Text()
+		user, rest := splitAuthLine(line)
+		if user == "" {
+			continue
 		}
+		rec, err := parseAuthRecord(rest)
+		if err != nil {
+			return nil, fmt.Errorf("auth file: user %q: %w", user, err)
+		}
+		db[user] = rec
 	}
 	err = scanner.Err()
 	return
 }
+
+func splitAuthLine(line string) (user, rest string) {
+	split := strings.SplitN(line, ":", 2)
+	if len(split) != 2 {
+		return "", ""
+	}
+	return split[0], split[1]
+}
+
+func parseAuthRecord(rest string) (authRecord, error) {
+	if !strings.HasPrefix(rest, "SCRAM-SHA-256$") && !strings.HasPrefix(rest, "SCRAM-SHA-1$") {
+		return authRecord{scheme: "plain", password: rest}, nil
+	}
+	fields := strings.Split(rest, ":")
+	if len(fields) != 4 {
+		return authRecord{}, errors.New("malformed SCRAM record")
+	}
+	nameIters := strings.SplitN(fields[0], "$", 2)
+	if len(nameIters) != 2 {
+		return authRecord{}, errors.New("malformed SCRAM record")
+	}
+	var scheme string
+	switch nameIters[0] {
+	case "SCRAM-SHA-256":
+		scheme = schemeScramSHA256
+	case "SCRAM-SHA-1":
+		scheme = schemeScramSHA1
+	}
+	iters, err := strconv.Atoi(nameIters[1])
+	if err != nil {
+		return authRecord{}, fmt.Errorf("bad iteration count: %w", err)
+	}
+	salt, err := base64.StdEncoding.DecodeString(fields[1])
+	if err != nil {
+		return authRecord{}, fmt.Errorf("bad salt: %w", err)
+	}
+	storedKey, err := base64.StdEncoding.DecodeString(fields[2])
+	if err != nil {
+		return authRecord{}, fmt.Errorf("bad StoredKey: %w", err)
+	}
+	serverKey, err := base64.StdEncoding.DecodeString(fields[3])
+	if err != nil {
+		return authRecord{}, fmt.Errorf("bad ServerKey: %w", err)
+	}
+	return authRecord{scheme: scheme, iters: iters, salt: salt, storedKey: storedKey, serverKey: serverKey}, nil
+}
+
+// readRoutes parses a domain-to-backend routing file. Each line has the form
+//
+//	domain backend [key=value,key=value,...]
+//
+// e.g.
+//
+//	ntfy.sh       ntfy    url=https://ntfy.sh/mytopic
+//	gotify.local  gotify  url=https://gotify.example.com,token=abc123
+//
+// pushoverToken is used as the default token for "pushover" backend lines
+// that don't supply their own token= param.
+func readRoutes(fd *os.File, pushoverToken string) (map[string]Notifier, error) {
+	notifiers := make(map[string]Notifier)
+	scanner := bufio.NewScanner(fd)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("malformed route line: %q", line)
+		}
+		domain, backend := fields[0], fields[1]
+		params := make(map[string]string)
+		if len(fields) >= 3 {
+			for _, kv := range strings.Split(fields[2], ",") {
+				split := strings.SplitN(kv, "=", 2)
+				if len(split) == 2 {
+					params[split[0]] = split[1]
+				}
+			}
+		}
+		n, err := buildNotifier(backend, params, pushoverToken)
+		if err != nil {
+			return nil, fmt.Errorf("route %q: %w", domain, err)
+		}
+		notifiers[domain] = n
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return notifiers, nil
+}
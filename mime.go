@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/base64"
+	"html"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxAttachmentBytes bounds the size of an image forwarded as a Pushover
+// attachment; Pushover itself caps attachments at 2.5MB.
+// https://pushover.net/api#attachments
+const maxAttachmentBytes = 2500000
+
+// attachment is a small binary MIME part worth forwarding alongside a
+// notification, e.g. an inline or attached image.
+type attachment struct {
+	Filename    string
+	ContentType string
+	Data        []byte
+}
+
+// decodeSubject decodes RFC 2047 encoded-words (e.g. "=?UTF-8?Q?...?=") in a
+// header value, returning the raw value unchanged if it isn't encoded.
+func decodeSubject(raw string) string {
+	dec := new(mime.WordDecoder)
+	decoded, err := dec.DecodeHeader(raw)
+	if err != nil {
+		return raw
+	}
+	return decoded
+}
+
+// bodyExtract walks a parsed mail.Message's MIME structure and returns
+// plain-text suitable for a notification body, truncated to maxLen, plus the
+// image attachments walkMultipart collects. It prefers a text/plain part,
+// falling back to stripping tags from text/html, and transparently decodes
+// quoted-printable and base64 transfer encodings.
+func bodyExtract(msg *mail.Message, maxLen int) (text string, attachments []attachment, err error) {
+	mediaType, params, perr := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if perr != nil {
+		mediaType = "text/plain"
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		text, attachments, err = walkMultipart(msg.Body, params["boundary"])
+		if err != nil {
+			return "", nil, err
+		}
+	} else {
+		body, derr := decodeTransfer(msg.Body, msg.Header.Get("Content-Transfer-Encoding"))
+		if derr != nil {
+			return "", nil, derr
+		}
+		if mediaType == "text/html" {
+			text = htmlToText(string(body))
+		} else {
+			text = string(body)
+		}
+	}
+	return truncate(strings.TrimSpace(text), maxLen), attachments, nil
+}
+
+// walkMultipart recurses through a multipart MIME body, returning the first
+// text/plain part found (or text/html, stripped to text, if no plain part
+// exists) along with small image attachments. An image part is skipped once
+// any attachment has already been collected, though a nested multipart part
+// may still append its own.
+func walkMultipart(r io.Reader, boundary string) (text string, attachments []attachment, err error) {
+	if boundary == "" {
+		return "", nil, nil
+	}
+	var htmlText string
+	mr := multipart.NewReader(r, boundary)
+	for {
+		part, perr := mr.NextPart()
+		if perr == io.EOF {
+			break
+		}
+		if perr != nil {
+			return text, attachments, perr
+		}
+		mediaType, params, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+
+		if strings.HasPrefix(mediaType, "multipart/") {
+			nestedText, nestedAttachments, nerr := walkMultipart(part, params["boundary"])
+			if nerr != nil {
+				continue
+			}
+			if text == "" {
+				text = nestedText
+			}
+			attachments = append(attachments, nestedAttachments...)
+			continue
+		}
+
+		if strings.HasPrefix(mediaType, "image/") {
+			if len(attachments) == 0 {
+				data, derr := decodeTransfer(part, part.Header.Get("Content-Transfer-Encoding"))
+				if derr == nil && len(data) > 0 && len(data) <= maxAttachmentBytes {
+					attachments = append(attachments, attachment{
+						Filename:    part.FileName(),
+						ContentType: mediaType,
+						Data:        data,
+					})
+				}
+			}
+			continue
+		}
+
+		if mediaType != "text/plain" && mediaType != "text/html" {
+			continue
+		}
+		data, derr := decodeTransfer(part, part.Header.Get("Content-Transfer-Encoding"))
+		if derr != nil {
+			continue
+		}
+		switch mediaType {
+		case "text/plain":
+			if text == "" {
+				text = string(data)
+			}
+		case "text/html":
+			if htmlText == "" {
+				htmlText = htmlToText(string(data))
+			}
+		}
+	}
+	if text == "" {
+		text = htmlText
+	}
+	return text, attachments, nil
+}
+
+// decodeTransfer reads r fully, decoding a quoted-printable or base64
+// Content-Transfer-Encoding if one applies.
+func decodeTransfer(r io.Reader, encoding string) ([]byte, error) {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "quoted-printable":
+		return ioutil.ReadAll(quotedprintable.NewReader(r))
+	case "base64":
+		return ioutil.ReadAll(base64.NewDecoder(base64.StdEncoding, r))
+	default:
+		return ioutil.ReadAll(r)
+	}
+}
+
+var (
+	htmlTagRe         = regexp.MustCompile(`(?s)<[^>]*>`)
+	htmlScriptStyleRe = regexp.MustCompile(`(?is)<(script|style)[^>]*>.*?</\s*(script|style)\s*>`)
+	htmlBlockBreakRe  = regexp.MustCompile(`(?i)<(br|/p|/div|/tr|/li)\s*/?>`)
+	htmlWhitespaceRe  = regexp.MustCompile(`[ \t]*\n[ \t]*`)
+)
+
+// htmlToText makes a best-effort plaintext rendering of an HTML body: drop
+// script/style blocks, strip tags, unescape entities, and collapse
+// whitespace left behind by block-level elements.
+func htmlToText(s string) string {
+	s = htmlScriptStyleRe.ReplaceAllString(s, "")
+	s = htmlBlockBreakRe.ReplaceAllString(s, "\n")
+	s = htmlTagRe.ReplaceAllString(s, "")
+	s = html.UnescapeString(s)
+	s = htmlWhitespaceRe.ReplaceAllString(s, "\n")
+	return strings.TrimSpace(s)
+}
+
+// ellipsis is appended to a truncated string; it's 3 bytes in UTF-8, not 1,
+// so truncate must reserve all 3 or the result can exceed max.
+const ellipsis = "…"
+
+// truncate shortens s to at most max bytes, replacing the tail with an
+// ellipsis if it was cut off and max has room for more than the ellipsis
+// alone (otherwise it is simply cut). The cut is walked back to a rune boundary so a
+// multi-byte UTF-8 character is never split in two.
+func truncate(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	cut := max
+	if max > len(ellipsis) {
+		cut = max - len(ellipsis)
+	}
+	for cut > 0 && !utf8.RuneStart(s[cut]) {
+		cut--
+	}
+	if max > len(ellipsis) {
+		return s[:cut] + ellipsis
+	}
+	return s[:cut]
+}
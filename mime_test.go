@@ -0,0 +1,69 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestTruncateNoopWhenUnderLimit(t *testing.T) {
+	got := truncate("hello", 10)
+	if got != "hello" {
+		t.Errorf("truncate(%q, 10) = %q, want unchanged", "hello", got)
+	}
+}
+
+func TestTruncateStaysWithinByteLimit(t *testing.T) {
+	// Regression test: the ellipsis is 3 bytes in UTF-8, not 1, so
+	// truncate must reserve all 3 or the result exceeds max.
+	s := strings.Repeat("a", 2000)
+	got := truncate(s, 1024)
+	if len(got) > 1024 {
+		t.Errorf("truncate(2000 bytes, 1024) = %d bytes, want <= 1024", len(got))
+	}
+	if !strings.HasSuffix(got, "…") {
+		t.Errorf("truncate(%d bytes, 1024) = %q, want an ellipsis suffix", len(s), got)
+	}
+}
+
+func TestTruncateRuneBoundary(t *testing.T) {
+	// Regression test: truncating by raw byte index can land inside a
+	// multi-byte rune and produce invalid UTF-8.
+	s := "wörld test é character"
+	for max := 1; max <= len(s); max++ {
+		got := truncate(s, max)
+		if !utf8.ValidString(got) {
+			t.Fatalf("truncate(%q, %d) = %q, not valid UTF-8", s, max, got)
+		}
+		if len(got) > max {
+			t.Fatalf("truncate(%q, %d) = %q (%d bytes), exceeds max", s, max, got, len(got))
+		}
+	}
+}
+
+func TestDecodeSubjectRFC2047(t *testing.T) {
+	got := decodeSubject("=?UTF-8?Q?h=C3=A9llo?=")
+	if got != "héllo" {
+		t.Errorf("decodeSubject = %q, want %q", got, "héllo")
+	}
+}
+
+func TestDecodeSubjectPassesThroughPlainText(t *testing.T) {
+	got := decodeSubject("plain subject")
+	if got != "plain subject" {
+		t.Errorf("decodeSubject = %q, want unchanged", got)
+	}
+}
+
+func TestHtmlToTextStripsTagsAndCollapsesBreaks(t *testing.T) {
+	got := htmlToText("<p>Hello<br>World</p><script>evil()</script>")
+	if strings.Contains(got, "evil") {
+		t.Errorf("htmlToText = %q, script contents leaked", got)
+	}
+	if !strings.Contains(got, "Hello") || !strings.Contains(got, "World") {
+		t.Errorf("htmlToText = %q, want both Hello and World", got)
+	}
+	if got != "Hello\nWorld" {
+		t.Errorf("htmlToText = %q, want %q", got, "Hello\nWorld")
+	}
+}
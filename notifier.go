@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gregdel/pushover"
+)
+
+// A Notifier delivers an Envelope to some push notification backend. The
+// retryable return value tells the caller whether the same Envelope may be
+// resubmitted after a transient failure.
+type Notifier interface {
+	Notify(e *Envelope) (retryable bool, err error)
+}
+
+// maxGenericBodyLen bounds the notification body for backends, other than
+// Pushover, that don't document a hard length limit of their own.
+const maxGenericBodyLen = 4096
+
+// httpClient is shared by the Gotify, ntfy, Matrix, and webhook Notifiers
+// below; PushoverNotifier goes through the pushover package instead. runWorker
+// delivers a batch concurrently and waits for all of it, so a backend that
+// accepts a connection and then never responds would otherwise hang its
+// goroutine, and with it every later batch, forever; bound every request
+// instead.
+var httpClient = &http.Client{Timeout: 15 * time.Second}
+
+// notificationText pulls a decoded subject, extracted body text, and any
+// image attachments out of an Envelope's MIME message.
+func notificationText(e *Envelope, maxLen int) (subject, body string, attachments []attachment, err error) {
+	subject = decodeSubject(e.Msg.Header.Get("Subject"))
+	if subject == "" {
+		subject = "(no subject)"
+	}
+	body, attachments, err = bodyExtract(e.Msg, maxLen)
+	return subject, body, attachments, err
+}
+
+// maxPushoverBodyLen is Pushover's message length limit.
+// https://pushover.net/api#limits
+const maxPushoverBodyLen = 1024
+
+// PushoverNotifier delivers envelopes to Pushover, the original backend for
+// SMTP Translator.
+type PushoverNotifier struct {
+	api *pushover.Pushover
+}
+
+// NewPushoverNotifier builds a PushoverNotifier authenticated with the given
+// application token.
+func NewPushoverNotifier(token string) *PushoverNotifier {
+	return &PushoverNotifier{api: pushover.New(token)}
+}
+
+func (p *PushoverNotifier) Notify(e *Envelope) (retryable bool, err error) {
+	sub, body, attachments, err := notificationText(e, maxPushoverBodyLen)
+	if err != nil {
+		return false, err
+	}
+	user, _ := parseEmail(e.To)
+	rcpt := pushover.NewRecipient(user)
+	if _, err = p.api.GetRecipientDetails(rcpt); err != nil {
+		return false, err
+	}
+	push := pushover.NewMessageWithTitle(body, sub+" ("+e.From+")")
+	if len(attachments) > 0 {
+		// A rejected attachment shouldn't sink an otherwise-deliverable
+		// notification, so this error is intentionally not fatal.
+		push.AddAttachment(bytes.NewReader(attachments[0].Data))
+	}
+	if e.Priority != nil {
+		push.Priority = *e.Priority
+	}
+	if e.Sound != "" {
+		push.Sound = e.Sound
+	}
+	if e.Device != "" {
+		push.DeviceName = e.Device
+	}
+	if e.TTL > 0 {
+		push.Expire = time.Duration(e.TTL) * time.Second
+	}
+	if e.Retry > 0 {
+		push.Retry = time.Duration(e.Retry) * time.Second
+	}
+	resp, err := p.api.SendMessage(push, rcpt)
+	if err != nil {
+		return resp != nil && resp.Status != 1, err
+	}
+	return false, nil
+}
+
+// GotifyNotifier delivers envelopes to a self-hosted Gotify server via its
+// REST message API.
+type GotifyNotifier struct {
+	URL   string
+	Token string
+}
+
+func (g *GotifyNotifier) Notify(e *Envelope) (retryable bool, err error) {
+	sub, body, _, err := notificationText(e, maxGenericBodyLen)
+	if err != nil {
+		return false, err
+	}
+	payload, err := json.Marshal(map[string]interface{}{
+		"title":   sub + " (" + e.From + ")",
+		"message": body,
+	})
+	if err != nil {
+		return false, err
+	}
+	resp, err := httpClient.Post(g.URL+"/message?token="+g.Token, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return true, fmt.Errorf("gotify: server error: %s", resp.Status)
+	}
+	if resp.StatusCode >= 400 {
+		return false, fmt.Errorf("gotify: rejected: %s", resp.Status)
+	}
+	return false, nil
+}
+
+// NtfyNotifier delivers envelopes to an ntfy.sh (or self-hosted ntfy) topic.
+type NtfyNotifier struct {
+	URL string // full topic URL, e.g. https://ntfy.sh/mytopic
+}
+
+func (n *NtfyNotifier) Notify(e *Envelope) (retryable bool, err error) {
+	sub, body, _, err := notificationText(e, maxGenericBodyLen)
+	if err != nil {
+		return false, err
+	}
+	req, err := http.NewRequest(http.MethodPost, n.URL, strings.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Title", sub+" ("+e.From+")")
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return true, fmt.Errorf("ntfy: server error: %s", resp.Status)
+	}
+	if resp.StatusCode >= 400 {
+		return false, fmt.Errorf("ntfy: rejected: %s", resp.Status)
+	}
+	return false, nil
+}
+
+// MatrixNotifier delivers envelopes as messages in a Matrix room via the
+// client-server API's send-message endpoint.
+type MatrixNotifier struct {
+	Homeserver string
+	Room       string
+	Token      string
+}
+
+func (m *MatrixNotifier) Notify(e *Envelope) (retryable bool, err error) {
+	sub, body, _, err := notificationText(e, maxGenericBodyLen)
+	if err != nil {
+		return false, err
+	}
+	payload, err := json.Marshal(map[string]interface{}{
+		"msgtype": "m.text",
+		"body":    fmt.Sprintf("%s (%s)\n\n%s", sub, e.From, body),
+	})
+	if err != nil {
+		return false, err
+	}
+	url := fmt.Sprintf("%s/_matrix/client/r0/rooms/%s/send/m.room.message?access_token=%s",
+		m.Homeserver, m.Room, m.Token)
+	resp, err := httpClient.Post(url, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return true, fmt.Errorf("matrix: server error: %s", resp.Status)
+	}
+	if resp.StatusCode >= 400 {
+		return false, fmt.Errorf("matrix: rejected: %s", resp.Status)
+	}
+	return false, nil
+}
+
+// WebhookNotifier delivers envelopes as a generic JSON POST, for backends
+// that don't warrant a dedicated implementation.
+type WebhookNotifier struct {
+	URL string
+}
+
+func (w *WebhookNotifier) Notify(e *Envelope) (retryable bool, err error) {
+	sub, body, _, err := notificationText(e, maxGenericBodyLen)
+	if err != nil {
+		return false, err
+	}
+	payload, err := json.Marshal(map[string]interface{}{
+		"from":    e.From,
+		"to":      e.To,
+		"subject": sub,
+		"body":    body,
+	})
+	if err != nil {
+		return false, err
+	}
+	resp, err := httpClient.Post(w.URL, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return true, fmt.Errorf("webhook: server error: %s", resp.Status)
+	}
+	if resp.StatusCode >= 400 {
+		return false, fmt.Errorf("webhook: rejected: %s", resp.Status)
+	}
+	return false, nil
+}
+
+// buildNotifier constructs a Notifier for the given backend type using
+// params parsed from a route file line. See readRoutes.
+func buildNotifier(backend string, params map[string]string, pushoverToken string) (Notifier, error) {
+	switch backend {
+	case "pushover":
+		token := params["token"]
+		if token == "" {
+			token = pushoverToken
+		}
+		if token == "" {
+			return nil, errors.New("pushover: missing token (set $PUSHOVER_TOKEN or token= param)")
+		}
+		return NewPushoverNotifier(token), nil
+	case "gotify":
+		if params["url"] == "" || params["token"] == "" {
+			return nil, errors.New("gotify: requires url= and token= params")
+		}
+		return &GotifyNotifier{URL: params["url"], Token: params["token"]}, nil
+	case "ntfy":
+		if params["url"] == "" {
+			return nil, errors.New("ntfy: requires url= param")
+		}
+		return &NtfyNotifier{URL: params["url"]}, nil
+	case "matrix":
+		if params["homeserver"] == "" || params["room"] == "" || params["token"] == "" {
+			return nil, errors.New("matrix: requires homeserver=, room=, and token= params")
+		}
+		return &MatrixNotifier{Homeserver: params["homeserver"], Room: params["room"], Token: params["token"]}, nil
+	case "webhook":
+		if params["url"] == "" {
+			return nil, errors.New("webhook: requires url= param")
+		}
+		return &WebhookNotifier{URL: params["url"]}, nil
+	default:
+		return nil, fmt.Errorf("unknown notifier backend: %s", backend)
+	}
+}
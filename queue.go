@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// spoolMeta is the JSON sidecar persisted alongside each spooled message.
+type spoolMeta struct {
+	From        string    `json:"from"`
+	To          string    `json:"to"`
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"next_attempt"`
+}
+
+// Queue is a durable, maildir-style spool directory. Envelopes accepted over
+// SMTP are written to disk before the SMTP transaction is acknowledged, so
+// they survive a crash or restart. A worker claims due messages, retries
+// transient failures with exponential backoff and jitter, and moves anything
+// that exhausts MaxAttempts into a dead-letter directory as an RFC 822 file.
+type Queue struct {
+	Dir         string
+	DlqDir      string
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+// NewQueue opens (creating if necessary) a spool directory rooted at dir.
+func NewQueue(dir string, maxAttempts int) (*Queue, error) {
+	dlqDir := filepath.Join(dir, "dlq")
+	if err := os.MkdirAll(dlqDir, 0700); err != nil {
+		return nil, err
+	}
+	return &Queue{
+		Dir:         dir,
+		DlqDir:      dlqDir,
+		MaxAttempts: maxAttempts,
+		BaseDelay:   10 * time.Second,
+		MaxDelay:    10 * time.Minute,
+	}, nil
+}
+
+// Enqueue durably stores an Envelope for later delivery, writing the raw
+// RFC 822 data and a JSON metadata sidecar via a temp-file-then-rename so a
+// crash mid-write never leaves a partial entry visible to the worker.
+func (q *Queue) Enqueue(from, to string, data []byte) (id string, err error) {
+	id = fmt.Sprintf("%d-%s", time.Now().UnixNano(), sanitizeID(to))
+	if err = q.writeFile(id+".eml", data); err != nil {
+		return "", err
+	}
+	meta := spoolMeta{From: from, To: to, NextAttempt: time.Now()}
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return "", err
+	}
+	if err = q.writeFile(id+".json", b); err != nil {
+		os.Remove(filepath.Join(q.Dir, id+".eml"))
+		return "", err
+	}
+	return id, nil
+}
+
+// Due returns the ids of spooled envelopes whose next attempt is not in the
+// future, oldest first.
+func (q *Queue) Due(now time.Time) ([]string, error) {
+	entries, err := ioutil.ReadDir(q.Dir)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, fi := range entries {
+		name := fi.Name()
+		if fi.IsDir() || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		id := strings.TrimSuffix(name, ".json")
+		meta, err := q.readMeta(id)
+		if err != nil {
+			continue
+		}
+		if !meta.NextAttempt.After(now) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// Load reads back the Envelope and metadata for a spooled id.
+func (q *Queue) Load(id string) (*Envelope, spoolMeta, error) {
+	meta, err := q.readMeta(id)
+	if err != nil {
+		return nil, meta, err
+	}
+	f, err := os.Open(filepath.Join(q.Dir, id+".eml"))
+	if err != nil {
+		return nil, meta, err
+	}
+	defer f.Close()
+	msg, err := mail.ReadMessage(f)
+	if err != nil {
+		return nil, meta, err
+	}
+	return &Envelope{From: meta.From, To: meta.To, Msg: msg}, meta, nil
+}
+
+// Done removes a delivered envelope from the spool.
+func (q *Queue) Done(id string) error {
+	os.Remove(filepath.Join(q.Dir, id+".json"))
+	return os.Remove(filepath.Join(q.Dir, id+".eml"))
+}
+
+// Retry records a failed delivery attempt. Once meta.Attempts reaches
+// MaxAttempts the envelope is moved to the dead-letter directory instead of
+// being rescheduled.
+func (q *Queue) Retry(id string, meta spoolMeta) (dead bool, err error) {
+	meta.Attempts++
+	if meta.Attempts >= q.MaxAttempts {
+		return true, q.dead(id)
+	}
+	meta.NextAttempt = time.Now().Add(q.backoff(meta.Attempts))
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return false, err
+	}
+	return false, q.writeFile(id+".json", b)
+}
+
+// dead moves a spooled envelope's raw RFC 822 data into the dead-letter
+// directory for operator inspection and removes it from the active spool.
+func (q *Queue) dead(id string) error {
+	if err := os.Rename(filepath.Join(q.Dir, id+".eml"), filepath.Join(q.DlqDir, id+".eml")); err != nil {
+		return err
+	}
+	return os.Remove(filepath.Join(q.Dir, id+".json"))
+}
+
+// Depth reports the number of envelopes currently spooled (excluding the DLQ).
+func (q *Queue) Depth() (int, error) {
+	entries, err := ioutil.ReadDir(q.Dir)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, fi := range entries {
+		if strings.HasSuffix(fi.Name(), ".eml") {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// backoff computes an exponential delay with jitter for the given attempt
+// count, capped at MaxDelay.
+func (q *Queue) backoff(attempts int) time.Duration {
+	d := q.BaseDelay * time.Duration(1<<uint(attempts-1))
+	if d > q.MaxDelay || d <= 0 {
+		d = q.MaxDelay
+	}
+	jitter := time.Duration(rand.Int63n(int64(d) / 2))
+	return d/2 + jitter
+}
+
+func (q *Queue) readMeta(id string) (spoolMeta, error) {
+	var meta spoolMeta
+	b, err := ioutil.ReadFile(filepath.Join(q.Dir, id+".json"))
+	if err != nil {
+		return meta, err
+	}
+	err = json.Unmarshal(b, &meta)
+	return meta, err
+}
+
+// writeFile writes to a temp file in Dir and renames it into place, so
+// readers never observe a partially-written entry.
+func (q *Queue) writeFile(name string, data []byte) error {
+	tmp := filepath.Join(q.Dir, "."+name+".tmp")
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(q.Dir, name))
+}
+
+func sanitizeID(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		default:
+			return '_'
+		}
+	}, s)
+}
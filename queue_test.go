@@ -0,0 +1,160 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestQueue(t *testing.T, maxAttempts int) *Queue {
+	t.Helper()
+	q, err := NewQueue(t.TempDir(), maxAttempts)
+	if err != nil {
+		t.Fatalf("NewQueue: %v", err)
+	}
+	return q
+}
+
+func TestQueueEnqueueDueLoadDone(t *testing.T) {
+	q := newTestQueue(t, 8)
+	id, err := q.Enqueue("from@example.com", "to@example.com", []byte("Subject: hi\r\n\r\nbody\r\n"))
+	if err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+
+	ids, err := q.Due(time.Now())
+	if err != nil {
+		t.Fatalf("Due: %v", err)
+	}
+	if len(ids) != 1 || ids[0] != id {
+		t.Fatalf("Due = %v, want [%s]", ids, id)
+	}
+
+	e, meta, err := q.Load(id)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if e.From != "from@example.com" || e.To != "to@example.com" {
+		t.Errorf("Load envelope = %+v, want from/to round-tripped", e)
+	}
+	if meta.Attempts != 0 {
+		t.Errorf("meta.Attempts = %d, want 0", meta.Attempts)
+	}
+
+	if err := q.Done(id); err != nil {
+		t.Fatalf("Done: %v", err)
+	}
+	ids, err = q.Due(time.Now())
+	if err != nil {
+		t.Fatalf("Due after Done: %v", err)
+	}
+	if len(ids) != 0 {
+		t.Errorf("Due after Done = %v, want empty", ids)
+	}
+}
+
+func TestQueueRetryReschedulesUntilMaxAttempts(t *testing.T) {
+	q := newTestQueue(t, 3)
+	id, err := q.Enqueue("from@example.com", "to@example.com", []byte("Subject: hi\r\n\r\nbody\r\n"))
+	if err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+
+	_, meta, err := q.Load(id)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+
+	dead, err := q.Retry(id, meta)
+	if err != nil {
+		t.Fatalf("Retry: %v", err)
+	}
+	if dead {
+		t.Fatalf("Retry reported dead after 1 attempt with MaxAttempts=3")
+	}
+	_, meta, err = q.Load(id)
+	if err != nil {
+		t.Fatalf("Load after Retry: %v", err)
+	}
+	if meta.Attempts != 1 {
+		t.Errorf("meta.Attempts = %d, want 1", meta.Attempts)
+	}
+	if !meta.NextAttempt.After(time.Now()) {
+		t.Errorf("NextAttempt = %v, want a time in the future", meta.NextAttempt)
+	}
+
+	// A second failure still reschedules; the third reaches MaxAttempts and
+	// should dead-letter the entry.
+	_, meta, _ = q.Load(id)
+	dead, err = q.Retry(id, meta)
+	if err != nil {
+		t.Fatalf("Retry: %v", err)
+	}
+	if dead {
+		t.Fatalf("Retry reported dead after 2 attempts with MaxAttempts=3")
+	}
+	_, meta, _ = q.Load(id)
+	dead, err = q.Retry(id, meta)
+	if err != nil {
+		t.Fatalf("Retry: %v", err)
+	}
+	if !dead {
+		t.Fatalf("Retry did not report dead after reaching MaxAttempts=3")
+	}
+
+	if _, err := os.Stat(filepath.Join(q.DlqDir, id+".eml")); err != nil {
+		t.Errorf("dead-lettered message not found in DLQ: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(q.Dir, id+".json")); !os.IsNotExist(err) {
+		t.Errorf("metadata sidecar still present in spool after dead-lettering")
+	}
+}
+
+func TestQueueBackoffCapsAtMaxDelay(t *testing.T) {
+	q := newTestQueue(t, 50)
+	q.BaseDelay = time.Second
+	q.MaxDelay = 10 * time.Second
+
+	for attempt := 1; attempt <= 20; attempt++ {
+		d := q.backoff(attempt)
+		if d > q.MaxDelay {
+			t.Errorf("backoff(%d) = %v, want <= MaxDelay %v", attempt, d, q.MaxDelay)
+		}
+		if d <= 0 {
+			t.Errorf("backoff(%d) = %v, want positive", attempt, d)
+		}
+	}
+}
+
+func TestQueueDepthExcludesDLQ(t *testing.T) {
+	q := newTestQueue(t, 1)
+	if _, err := q.Enqueue("from@example.com", "a@example.com", []byte("x")); err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+	id, err := q.Enqueue("from@example.com", "b@example.com", []byte("x"))
+	if err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+
+	depth, err := q.Depth()
+	if err != nil {
+		t.Fatalf("Depth: %v", err)
+	}
+	if depth != 2 {
+		t.Fatalf("Depth = %d, want 2", depth)
+	}
+
+	_, meta, _ := q.Load(id)
+	if _, err := q.Retry(id, meta); err != nil {
+		t.Fatalf("Retry: %v", err)
+	}
+
+	depth, err = q.Depth()
+	if err != nil {
+		t.Fatalf("Depth after dead-letter: %v", err)
+	}
+	if depth != 1 {
+		t.Errorf("Depth after dead-lettering one entry = %d, want 1", depth)
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Rule maps envelopes whose sender and/or subject match a pattern to
+// Pushover-specific notification parameters (priority, sound, device, and
+// retry/expire timing). A zero value for any parameter means "leave it at
+// the backend's default".
+type Rule struct {
+	From    *regexp.Regexp
+	Subject *regexp.Regexp
+
+	Priority *int
+	Sound    string
+	Device   string
+	TTL      int // Pushover "expire", in seconds
+	Retry    int // Pushover "retry", in seconds
+}
+
+// Rules is an ordered list of routing rules, evaluated first-match-wins.
+type Rules []Rule
+
+// Match returns the first Rule whose set patterns all match, if any.
+func (rs Rules) Match(from, subject string) (Rule, bool) {
+	for _, r := range rs {
+		if r.From != nil && !r.From.MatchString(from) {
+			continue
+		}
+		if r.Subject != nil && !r.Subject.MatchString(subject) {
+			continue
+		}
+		return r, true
+	}
+	return Rule{}, false
+}
+
+// Apply inspects e before delivery: it strips any "[sendas:key=value,...]"
+// tag from the subject and applies its parameters, then fills in anything
+// left unset from the first matching Rule. An explicit sendas tag always
+// wins over a Rule, mirroring how a more specific setting should beat a
+// general one.
+func (rs Rules) Apply(e *Envelope) {
+	subject := e.Msg.Header.Get("Subject")
+	cleanSubject, tagParams := parseSendAsTag(subject)
+	if cleanSubject != subject {
+		e.Msg.Header["Subject"] = []string{cleanSubject}
+	}
+
+	if rule, ok := rs.Match(e.From, cleanSubject); ok {
+		e.Priority = rule.Priority
+		e.Sound = rule.Sound
+		e.Device = rule.Device
+		e.TTL = rule.TTL
+		e.Retry = rule.Retry
+	}
+	applySendAsParams(e, tagParams)
+}
+
+var sendAsTagRe = regexp.MustCompile(`\s*\[sendas:([^\]]*)\]`)
+
+// parseSendAsTag extracts a "[sendas:priority=2,sound=none]"-style tag from
+// a Subject, similar to send-as SMTP shims, returning the tag-stripped
+// subject and its key/value params.
+func parseSendAsTag(subject string) (string, map[string]string) {
+	m := sendAsTagRe.FindStringSubmatch(subject)
+	if m == nil {
+		return subject, nil
+	}
+	clean := strings.TrimSpace(sendAsTagRe.ReplaceAllString(subject, ""))
+	params := make(map[string]string)
+	for _, kv := range strings.Split(m[1], ",") {
+		split := strings.SplitN(kv, "=", 2)
+		if len(split) == 2 {
+			params[strings.TrimSpace(split[0])] = strings.TrimSpace(split[1])
+		}
+	}
+	return clean, params
+}
+
+func applySendAsParams(e *Envelope, params map[string]string) {
+	if v, ok := params["priority"]; ok {
+		if n, err := strconv.Atoi(v); err == nil {
+			e.Priority = &n
+		}
+	}
+	if v, ok := params["sound"]; ok {
+		e.Sound = v
+	}
+	if v, ok := params["device"]; ok {
+		e.Device = v
+	}
+	if v, ok := params["expire"]; ok {
+		if n, err := strconv.Atoi(v); err == nil {
+			e.TTL = n
+		}
+	}
+	if v, ok := params["retry"]; ok {
+		if n, err := strconv.Atoi(v); err == nil {
+			e.Retry = n
+		}
+	}
+}
+
+// readRules parses a routing rules file. This is the same hand-rolled,
+// line-oriented format as readRoutes/readAuth, not YAML or TOML: SMTP
+// Translator has no YAML/TOML dependency anywhere else, and this repo's
+// convention for its other config files is a small bufio.Scanner-based
+// parser rather than pulling one in. Each line has the form
+//
+//	<from|subject>="<regexp>" param=value[,param=value...]
+//
+// e.g.
+//
+//	subject="^\[CRIT\]"   priority=2,retry=60,expire=3600
+//	from="cron@backup"    sound=none,priority=-1
+func readRules(fd *os.File) (Rules, error) {
+	var rules Rules
+	scanner := bufio.NewScanner(fd)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.SplitN(line, " ", 2)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("malformed rule line: %q", line)
+		}
+		rule, err := parseRuleMatch(strings.TrimSpace(fields[0]))
+		if err != nil {
+			return nil, fmt.Errorf("rule %q: %w", line, err)
+		}
+		if err := parseRuleParams(&rule, strings.TrimSpace(fields[1])); err != nil {
+			return nil, fmt.Errorf("rule %q: %w", line, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, scanner.Err()
+}
+
+func parseRuleMatch(clause string) (Rule, error) {
+	field, value, err := splitQuoted(clause)
+	if err != nil {
+		return Rule{}, err
+	}
+	re, err := regexp.Compile(value)
+	if err != nil {
+		return Rule{}, err
+	}
+	switch field {
+	case "subject":
+		return Rule{Subject: re}, nil
+	case "from":
+		return Rule{From: re}, nil
+	default:
+		return Rule{}, fmt.Errorf("unknown match field: %s", field)
+	}
+}
+
+func splitQuoted(s string) (field, value string, err error) {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 {
+		return "", "", fmt.Errorf(`expected field="value": %q`, s)
+	}
+	value = parts[1]
+	if len(value) < 2 || value[0] != '"' || value[len(value)-1] != '"' {
+		return "", "", fmt.Errorf(`expected quoted value: %q`, s)
+	}
+	return parts[0], value[1 : len(value)-1], nil
+}
+
+func parseRuleParams(rule *Rule, params string) error {
+	for _, kv := range strings.Split(params, ",") {
+		split := strings.SplitN(kv, "=", 2)
+		if len(split) != 2 {
+			return fmt.Errorf("malformed param: %q", kv)
+		}
+		key, val := split[0], split[1]
+		switch key {
+		case "priority":
+			n, err := strconv.Atoi(val)
+			if err != nil {
+				return fmt.Errorf("priority: %w", err)
+			}
+			rule.Priority = &n
+		case "sound":
+			rule.Sound = val
+		case "device":
+			rule.Device = val
+		case "expire":
+			n, err := strconv.Atoi(val)
+			if err != nil {
+				return fmt.Errorf("expire: %w", err)
+			}
+			rule.TTL = n
+		case "retry":
+			n, err := strconv.Atoi(val)
+			if err != nil {
+				return fmt.Errorf("retry: %w", err)
+			}
+			rule.Retry = n
+		default:
+			return fmt.Errorf("unknown rule param: %s", key)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-sasl"
+	"github.com/emersion/go-smtp"
+)
+
+// maxMessageBytes is a generous, backend-agnostic ceiling on an incoming
+// message's size, independent of any notifier's own (much smaller)
+// notification length limit. It exists only to bound per-message memory use,
+// not to anticipate any particular backend's truncation.
+const maxMessageBytes = 10 * 1024 * 1024
+
+// cramMD5Mechanism is the AUTH mechanism name for CRAM-MD5. go-sasl has no
+// sasl.CramMD5 constant, since (like loginServer below) it never shipped a
+// server-side CRAM-MD5 implementation.
+const cramMD5Mechanism = "CRAM-MD5"
+
+// loginServer hand-rolls the classic two-prompt AUTH LOGIN exchange: go-sasl
+// only ships a client-side LOGIN implementation, so there's no
+// sasl.NewLoginServer to call.
+type loginServer struct {
+	auth func(username, password string) error
+
+	step int
+	user string
+}
+
+func newLoginServer(auth func(username, password string) error) sasl.Server {
+	return &loginServer{auth: auth}
+}
+
+func (s *loginServer) Next(response []byte) (challenge []byte, done bool, err error) {
+	switch s.step {
+	case 0:
+		s.step++
+		return []byte("Username:"), false, nil
+	case 1:
+		s.user = string(response)
+		s.step++
+		return []byte("Password:"), false, nil
+	case 2:
+		s.step++
+		return nil, true, s.auth(s.user, string(response))
+	default:
+		return nil, true, errors.New("login: unexpected additional round trip")
+	}
+}
+
+// cramMD5Server hand-rolls RFC 2195 CRAM-MD5: go-sasl ships neither a
+// sasl.NewCramMD5Server nor challenge generation for it, so both live here,
+// matching the shape scram.go uses for SCRAM.
+type cramMD5Server struct {
+	hostname string
+	auth     func(username string, response, challenge []byte) error
+
+	challenge []byte
+}
+
+func newCramMD5Server(hostname string, auth func(username string, response, challenge []byte) error) sasl.Server {
+	return &cramMD5Server{hostname: hostname, auth: auth}
+}
+
+func (s *cramMD5Server) Next(response []byte) (challenge []byte, done bool, err error) {
+	if s.challenge == nil {
+		nonce := make([]byte, 16)
+		if _, err := rand.Read(nonce); err != nil {
+			return nil, true, err
+		}
+		s.challenge = []byte(fmt.Sprintf("<%x.%d@%s>", nonce, time.Now().UnixNano(), s.hostname))
+		return s.challenge, false, nil
+	}
+	fields := strings.SplitN(string(response), " ", 2)
+	if len(fields) != 2 {
+		return nil, true, errors.New("cram-md5: malformed response")
+	}
+	return nil, true, s.auth(fields[0], []byte(fields[1]), s.challenge)
+}
+
+// Backend implements smtp.Backend. It hands out a fresh Session for every
+// connection so that auth state, the envelope sender, and accepted
+// recipients never leak between unrelated SMTP transactions.
+type Backend struct {
+	Config *Config
+	Queue  *Queue
+	Errl   *log.Logger
+}
+
+// NewSession satisfies smtp.Backend.
+func (b *Backend) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	return &Session{backend: b}, nil
+}
+
+// Session holds the per-connection state for a single SMTP (or LMTP)
+// transaction: the authenticated user, if any, the envelope sender, and the
+// recipients accepted so far. Authenticated user is threaded through here so
+// later work (per-user quotas, per-user backend token overrides) has
+// somewhere to hang off of.
+type Session struct {
+	backend *Backend
+	user    string
+	from    string
+	rcpts   []string
+}
+
+// AuthMechanisms advertises the mechanisms available for this session. No
+// auth database means the server is open and doesn't offer AUTH at all.
+func (s *Session) AuthMechanisms() []string {
+	if len(s.backend.Config.AuthDb) == 0 {
+		return nil
+	}
+	return []string{sasl.Plain, sasl.Login, cramMD5Mechanism, "SCRAM-SHA-256", "SCRAM-SHA-1"}
+}
+
+// Auth returns a sasl.Server for the requested mechanism, recording the
+// authenticated username on the session once the exchange succeeds.
+func (s *Session) Auth(mech string) (sasl.Server, error) {
+	db := s.backend.Config.AuthDb
+	switch mech {
+	case sasl.Plain:
+		return sasl.NewPlainServer(func(identity, username, password string) error {
+			if !authPlaintext(db, username, password) {
+				return errors.New("invalid username or password")
+			}
+			s.user = username
+			return nil
+		}), nil
+	case sasl.Login:
+		return newLoginServer(func(username, password string) error {
+			if !authPlaintext(db, username, password) {
+				return errors.New("invalid username or password")
+			}
+			s.user = username
+			return nil
+		}), nil
+	case cramMD5Mechanism:
+		return newCramMD5Server(s.backend.Config.Hostname, func(username string, response, challenge []byte) error {
+			ok, err := authCramMd5(db, username, response, challenge)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return errors.New("invalid username or challenge response")
+			}
+			s.user = username
+			return nil
+		}), nil
+	case "SCRAM-SHA-256":
+		return newScramServer(schemeScramSHA256, db, func(user string) error { s.user = user; return nil })
+	case "SCRAM-SHA-1":
+		return newScramServer(schemeScramSHA1, db, func(user string) error { s.user = user; return nil })
+	}
+	return nil, smtp.ErrAuthUnsupported
+}
+
+// Mail begins a new transaction. Beyond maxMessageBytes, which the server
+// itself enforces, there's no size limit to enforce here: which notifier
+// (and whose length limit) applies isn't known
+// until RCPT TO resolves a recipient's domain, so each Notifier truncates its
+// own notification text instead (see notificationText in notifier.go).
+func (s *Session) Mail(from string, opts *smtp.MailOptions) error {
+	s.from = from
+	s.rcpts = nil
+	return nil
+}
+
+// Rcpt accepts a recipient only if its domain has a configured Notifier.
+func (s *Session) Rcpt(to string, opts *smtp.RcptOptions) error {
+	_, dom := parseEmail(to)
+	if _, ok := s.backend.Config.Notifiers[dom]; !ok {
+		return &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+			Message:      "no notifier configured for domain " + dom,
+		}
+	}
+	s.rcpts = append(s.rcpts, to)
+	return nil
+}
+
+// Data spools the message for every accepted recipient; actual delivery
+// happens asynchronously out of the durable Queue. If every recipient fails
+// to spool, a 4xx is returned instead of the usual 250 OK so the client
+// knows to retry rather than believing a dropped message was accepted.
+func (s *Session) Data(r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	var spoolErr error
+	spooled := 0
+	for _, rcpt := range s.rcpts {
+		if _, err := s.backend.Queue.Enqueue(s.from, rcpt, data); err != nil {
+			s.backend.Errl.Println("spool write failed:", rcpt, err)
+			spoolErr = err
+			continue
+		}
+		spooled++
+	}
+	if spooled == 0 && spoolErr != nil {
+		return &smtp.SMTPError{
+			Code:         451,
+			EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+			Message:      "could not spool message, try again",
+		}
+	}
+	return nil
+}
+
+// Reset clears transaction state between MAIL commands on the same
+// connection.
+func (s *Session) Reset() {
+	s.from = ""
+	s.rcpts = nil
+}
+
+// Logout is a no-op; Session carries no resources that need closing.
+func (s *Session) Logout() error {
+	return nil
+}